@@ -73,6 +73,8 @@ package main
 
 import (
 	"container/list"
+	"crypto/sha256"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -89,6 +91,18 @@ const validCString string = `^[^\.].*\.c$`
 const validHString string = `^[^\.].*\.h$`
 const flushTime int = 10
 
+// debounceCheckInterval is how often handleFiles checks pendingChanges for
+// entries whose debounce window has elapsed. It is not configurable since
+// it only bounds how promptly a coalesced event is acted on, not how much
+// gets coalesced.
+const debounceCheckInterval = 20 * time.Millisecond
+
+// defaultDebounceWindow and defaultRescanInterval are the defaults for the
+// -debounce-window and -rescan-interval flags startFilesHandler's caller
+// exposes.
+const defaultDebounceWindow = 200 * time.Millisecond
+const defaultRescanInterval = 5 * time.Minute
+
 var sysInclDir = map[string]bool{
 	"/usr/include/": true,
 	"/usr/lib/":     true,
@@ -104,12 +118,217 @@ var foundFile, foundHeader, removeFile chan string
 var flush <-chan time.Time
 var newConn chan net.Conn
 
+// pendingChanges, debounceWindow and debounceTick implement the debouncing
+// layer between watcher.Events and handleChange: a git checkout or
+// make clean && make can otherwise enqueue thousands of reparses, many for
+// files that no longer exist by the time the parser gets to them.
+// pendingChanges lives here, read and written only from handleFiles, so it
+// needs no locking.
+var pendingChanges map[string]pendingChange
+var debounceWindow time.Duration
+var debounceTick <-chan time.Time
+
+// rescanTick drives the periodic full-tree rescan that catches anything
+// fsnotify missed (unreliable on NFS, overlayfs, some container setups).
+// rescanDone reports back when a triggered rescan finishes so handleFiles
+// can count it without touching stats from another goroutine.
+var rescanTick <-chan time.Time
+var rescanDone chan bool
+
+// stats are the counters exposed by the Stats request on RequestHandler:
+// events received/coalesced give a sense of how noisy the watched tree is,
+// rescansCompleted shows the periodic-rescan safety net is actually running.
+// statsMu guards stats: it is written from handleFiles (coalesceEvent and
+// the rescanDone case) and read from Stats, which
+// (*RequestHandler).Stats below exposes to request.go's dispatch.
+var statsMu sync.Mutex
+var stats struct {
+	eventsReceived   int
+	eventsCoalesced  int
+	rescansCompleted int
+}
+
+// Stats returns a snapshot of the debounce/rescan counters.
+func Stats() (eventsReceived, eventsCoalesced, rescansCompleted int) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return stats.eventsReceived, stats.eventsCoalesced, stats.rescansCompleted
+}
+
+// Stats is the RequestHandler-facing entry point for the debounce/rescan
+// counters (events received/coalesced, rescans completed).
+func (rh *RequestHandler) Stats() (eventsReceived, eventsCoalesced, rescansCompleted int) {
+	return Stats()
+}
+
+type pendingChange struct {
+	op       fsnotify.Op
+	deadline time.Time
+}
+
 var wg sync.WaitGroup
 var watcher *fsnotify.Watcher
 
 var db *symbolsDB
 var rh *RequestHandler
 
+var hashCheck bool
+
+// contentCacheMu guards contentCache, lastParsedDigest, lastParsedHeaders
+// and lastHeaderDigest. Unlike the rest of handleFiles' state, these are
+// also read and written from parse.(*parse).Parse, which runs in each of
+// the parallel parseFiles goroutines (nIndexingThreads of them) rather than
+// on handleFiles itself, so plain unsynchronized maps would race.
+var contentCacheMu sync.Mutex
+var contentCache map[string]contentCacheEntry
+
+// lastParsedDigest and lastParsedHeaders remember, for the file a given
+// path was last successfully parsed for, the content digest computed at
+// that time and the ordered header list it was computed over. needsReparse
+// compares a fresh digest against lastParsedDigest to tell a real content
+// change from an mtime-only one. Both live only in memory for this daemon's
+// lifetime: persisting them across restarts would mean adding fields to
+// symbolsTUDB and the DB flush path, which live in symbols-db.go outside
+// this chunk.
+var lastParsedDigest map[string][sha256.Size]byte
+var lastParsedHeaders map[string][]string
+
+// lastHeaderDigest is headerChanged's equivalent of lastParsedDigest, but
+// keyed by header path rather than by includer: a header's own mtime
+// flapping (a formatter or vim backup cycle touching a widely-included
+// .h) shouldn't fan out a reparse to every includer db.GetIncluders
+// returns unless the header's content actually changed.
+var lastHeaderDigest map[string][sha256.Size]byte
+
+// contentCacheEntry remembers the (size, mtime) pair a digest was computed
+// for, so a file only gets rehashed when one of those actually changed.
+type contentCacheEntry struct {
+	size   int64
+	mtime  time.Time
+	digest [sha256.Size]byte
+}
+
+// diagMu guards fileDiagnostics and lastNotifiedErrorCount, written from the
+// parseFiles goroutines (parse.(*parse).Parse, via recordDiagnostics) and
+// read from GetFileErrors/GetAllErrors.
+var diagMu sync.Mutex
+var fileDiagnostics map[string][]DiagInfo
+
+// lastNotifiedErrorCount remembers, per file, the diagnostic count the last
+// FileErrorEvent was sent for, so notifyIfErrorsChanged can tell a real
+// change in error count from doneFileToParse simply re-inserting the same
+// result (e.g. a no-op rescan).
+var lastNotifiedErrorCount map[string]int
+
+// recordDiagnostics remembers the diagnostics collected for file's most
+// recent parse, replacing whatever was recorded before.
+func recordDiagnostics(file string, diags []DiagInfo) {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	fileDiagnostics[file] = diags
+}
+
+// GetFileErrors returns the diagnostics collected the last time file was
+// parsed, or nil if it hasn't been parsed (or had none).
+func GetFileErrors(file string) []DiagInfo {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	return fileDiagnostics[file]
+}
+
+// GetAllErrors summarizes diagnostics across every parsed file as a count
+// by severity, for a folder-wide view of parse health.
+func GetAllErrors() map[string]int {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+
+	counts := map[string]int{}
+	for _, diags := range fileDiagnostics {
+		for _, d := range diags {
+			counts[d.Severity]++
+		}
+	}
+	return counts
+}
+
+// FileErrorEvent is what SubscribeErrors delivers: file's diagnostics as of
+// the parse that just landed in doneFileToParse.
+type FileErrorEvent struct {
+	File   string
+	Errors []DiagInfo
+}
+
+// errSubsMu guards errSubs, the set of channels currently registered
+// through (*RequestHandler).SubscribeErrors.
+var errSubsMu sync.Mutex
+var errSubs map[chan FileErrorEvent]bool
+
+// notifyErrorsChanged fans a FileErrorEvent for file out to every
+// subscriber. Sends are non-blocking: a subscriber that isn't keeping up
+// misses the event rather than stalling doneFileToParse, which runs on the
+// single handleFiles goroutine.
+func notifyErrorsChanged(file string, diags []DiagInfo) {
+	errSubsMu.Lock()
+	defer errSubsMu.Unlock()
+	for ch := range errSubs {
+		select {
+		case ch <- FileErrorEvent{File: file, Errors: diags}:
+		default:
+		}
+	}
+}
+
+// notifyIfErrorsChanged fires a FileErrorEvent when file's error count
+// actually moved since the last one sent for it. doneFileToParse calls it
+// only for a parse it inserts, not for one superseded by a newer queued parse.
+// This is the "SubscribeErrors" half of the request: a client watching the
+// stream learns a TUDB's error count changed without polling GetFileErrors.
+func notifyIfErrorsChanged(file string) {
+	diagMu.Lock()
+	diags := fileDiagnostics[file]
+	prev, hadPrev := lastNotifiedErrorCount[file]
+	count := len(diags)
+	lastNotifiedErrorCount[file] = count
+	diagMu.Unlock()
+
+	if hadPrev && prev == count {
+		return
+	}
+	notifyErrorsChanged(file, diags)
+}
+
+// GetFileErrors is the RequestHandler-facing entry point for
+// "why isn't jump-to-definition working on foo.c": it returns the
+// diagnostics collected the last time file was parsed.
+func (rh *RequestHandler) GetFileErrors(file string) []DiagInfo {
+	return GetFileErrors(file)
+}
+
+// GetAllErrors is the RequestHandler-facing entry point for a folder-wide
+// summary of parse health.
+func (rh *RequestHandler) GetAllErrors() map[string]int {
+	return GetAllErrors()
+}
+
+// SubscribeErrors registers ch to receive a FileErrorEvent whenever
+// doneFileToParse inserts a TUDB whose error count changed. The caller owns
+// ch (request.go, outside this chunk, would create one per subscribing
+// connection) and must call UnsubscribeErrors when it's done, typically
+// when the connection closes, so errSubs doesn't grow unbounded.
+func (rh *RequestHandler) SubscribeErrors(ch chan FileErrorEvent) {
+	errSubsMu.Lock()
+	defer errSubsMu.Unlock()
+	errSubs[ch] = true
+}
+
+// UnsubscribeErrors removes ch, registered by SubscribeErrors, from the
+// notification set.
+func (rh *RequestHandler) UnsubscribeErrors(ch chan FileErrorEvent) {
+	errSubsMu.Lock()
+	defer errSubsMu.Unlock()
+	delete(errSubs, ch)
+}
+
 func traversePath(path string, visitDir func(string), visitC func(string), visitRest func(string)) {
 	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -157,6 +376,7 @@ func queueFilesToParse(files ...string) {
 func doneFileToParse(tudb *symbolsTUDB) {
 	if !toParseMap[tudb.File] {
 		db.InsertTUDB(tudb)
+		notifyIfErrorsChanged(tudb.File)
 	}
 
 	delete(inFlight, tudb.File)
@@ -173,7 +393,187 @@ func doneFileToParse(tudb *symbolsTUDB) {
 	parseFile <- filePath
 }
 
+// hashFileInto streams path into h, returning false if it could not be read
+// (e.g. it was removed between the stat and the open).
+func hashFileInto(h io.Writer, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return err == nil
+}
+
+// contentDigest returns the SHA-256 of file's contents followed by the
+// contents of headers, in order, so that a digest only matches when both the
+// primary source and everything it pulls in are byte-identical to the last
+// parse. It consults contentCache first and only rehashes when the file's
+// (size, mtime) pair actually moved, since editors and git checkouts often
+// rewrite a file with identical content. Safe to call concurrently: it is
+// invoked both from handleFiles (needsReparse) and from the parseFiles
+// goroutines (parse.(*parse).Parse, once parsing completes).
+func contentDigest(file string, headers []string) ([sha256.Size]byte, bool) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+
+	contentCacheMu.Lock()
+	cached, ok := contentCache[file]
+	contentCacheMu.Unlock()
+	if ok && cached.size == info.Size() && cached.mtime.Equal(info.ModTime()) {
+		return cached.digest, true
+	}
+
+	h := sha256.New()
+	if !hashFileInto(h, file) {
+		return [sha256.Size]byte{}, false
+	}
+	for _, header := range headers {
+		if !hashFileInto(h, header) {
+			return [sha256.Size]byte{}, false
+		}
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	contentCacheMu.Lock()
+	contentCache[file] = contentCacheEntry{
+		size:   info.Size(),
+		mtime:  info.ModTime(),
+		digest: digest,
+	}
+	contentCacheMu.Unlock()
+
+	return digest, true
+}
+
+// recordParsedDigest remembers file's content digest (and the header list
+// it was computed over) as of a just-completed parse, so a later
+// mtime-only change to file can be recognized by needsReparse as a no-op.
+func recordParsedDigest(file string, headers []string, digest [sha256.Size]byte) {
+	contentCacheMu.Lock()
+	defer contentCacheMu.Unlock()
+	lastParsedDigest[file] = digest
+	lastParsedHeaders[file] = headers
+}
+
+// invalidateContentCache drops any cached digest for path. It must be called
+// whenever fsnotify tells us a file was written or removed, since the cached
+// (size, mtime) pair is no longer trustworthy. While path still exists (a
+// Write), the digests recorded at its last parse are kept as the baseline
+// needsReparse and headerChanged compare against; once it is gone they are
+// dropped too.
+func invalidateContentCache(path string) {
+	contentCacheMu.Lock()
+	defer contentCacheMu.Unlock()
+	delete(contentCache, path)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	delete(lastParsedDigest, path)
+	delete(lastParsedHeaders, path)
+	delete(lastHeaderDigest, path)
+}
+
+// GetContentHash returns the content digest computed the last time file was
+// parsed (the primary source plus its included headers, see contentDigest),
+// so a client can answer "has anything actually changed since digest X?"
+// for cache validation, as the request originally asked for. ok is false if
+// file hasn't been parsed this run, or was removed or renamed since.
+func GetContentHash(file string) (digest [sha256.Size]byte, ok bool) {
+	contentCacheMu.Lock()
+	defer contentCacheMu.Unlock()
+	digest, ok = lastParsedDigest[file]
+	return
+}
+
+// GetContentHash is the RequestHandler-facing entry point for the
+// "has anything actually changed since digest X?" cache-validation query.
+func (rh *RequestHandler) GetContentHash(file string) ([sha256.Size]byte, bool) {
+	return GetContentHash(file)
+}
+
+// needsReparse decides whether file should be (re)queued for parsing. It
+// first defers to db.UptodateFile for the common case (new file, or mtime
+// unchanged). When the mtime moved but -hash-check is enabled, it falls back
+// to comparing content digests so that editors/formatters that rewrite a
+// file without changing its content don't trigger a clang reparse.
+func needsReparse(file string) bool {
+	exist, uptodate, err := db.UptodateFile(file)
+	if err != nil {
+		// mirrors the previous foundFile handling: on a DB error we don't
+		// know the file's state, so leave it alone rather than reparse
+		return false
+	}
+	if !exist {
+		return true
+	}
+	if uptodate {
+		return false
+	}
+	if !hashCheck {
+		return true
+	}
+
+	contentCacheMu.Lock()
+	headers, haveHeaders := lastParsedHeaders[file]
+	prevDigest, haveDigest := lastParsedDigest[file]
+	contentCacheMu.Unlock()
+	if !haveHeaders || !haveDigest {
+		// never parsed this run (or removed since): no prior digest to
+		// compare against, so fall back to the mtime-based decision
+		return true
+	}
+
+	digest, ok := contentDigest(file, headers)
+	if !ok {
+		return true
+	}
+	return digest != prevDigest
+}
+
+// headerChanged is needsReparse's counterpart for headers: it reports
+// whether headerPath's content actually differs from the last time
+// parseIncluders looked at it. A header's own mtime is not tracked per
+// includer the way a .c file's is (db.UptodateFile only knows about the
+// includer, not the header), so this keeps its own digest rather than
+// reusing needsReparse directly.
+func headerChanged(headerPath string) bool {
+	if !hashCheck {
+		return true
+	}
+
+	h := sha256.New()
+	if !hashFileInto(h, headerPath) {
+		// can't read it (removed, or about to be): treat as changed so its
+		// includers still get a chance to react
+		return true
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	contentCacheMu.Lock()
+	prev, ok := lastHeaderDigest[headerPath]
+	lastHeaderDigest[headerPath] = digest
+	contentCacheMu.Unlock()
+
+	return !ok || digest != prev
+}
+
+// parseIncluders reparses every file db.GetIncluders says depends on
+// headerPath, unless -hash-check is enabled and headerChanged says the
+// header's content didn't actually move: a formatter or backup/restore
+// cycle touching a widely-included header shouldn't fan out a full reparse
+// storm to every includer.
 func parseIncluders(headerPath string) {
+	if !headerChanged(headerPath) {
+		return
+	}
+
 	toParse, err := db.GetIncluders(headerPath)
 	if err != nil {
 		log.Panic(err)
@@ -189,17 +589,80 @@ func handleFileChange(event fsnotify.Event) {
 	case validC:
 		switch {
 		case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
-			queueFilesToParse(event.Name)
+			if event.Op&fsnotify.Write != 0 {
+				invalidateContentCache(event.Name)
+			}
+			if needsReparse(event.Name) {
+				queueFilesToParse(event.Name)
+			}
 		case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+			invalidateContentCache(event.Name)
 			db.RemoveFileReferences(event.Name)
 		}
 	case validH:
+		if event.Op&(fsnotify.Write|fsnotify.Remove) != 0 {
+			invalidateContentCache(event.Name)
+		}
 		if event.Op&(fsnotify.Write|fsnotify.Remove|fsnotify.Rename|fsnotify.Create) != 0 {
 			parseIncluders(event.Name)
 		}
 	}
 }
 
+// coalesceEvent records event in pendingChanges, merging it with anything
+// already pending for the same path: a Create followed by a Write collapses
+// into a single Write, and a Remove/Rename always wins over whatever was
+// pending (there is no point writing a file that is about to disappear).
+// Either way the path's debounce window is restarted.
+func coalesceEvent(event fsnotify.Event) {
+	statsMu.Lock()
+	stats.eventsReceived++
+	statsMu.Unlock()
+
+	op := event.Op
+	if prev, ok := pendingChanges[event.Name]; ok {
+		statsMu.Lock()
+		stats.eventsCoalesced++
+		statsMu.Unlock()
+		switch {
+		case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+			op = event.Op
+		case prev.op&fsnotify.Create != 0 && event.Op&fsnotify.Write != 0:
+			op = fsnotify.Write
+		default:
+			op = prev.op | event.Op
+		}
+	}
+
+	pendingChanges[event.Name] = pendingChange{
+		op:       op,
+		deadline: time.Now().Add(debounceWindow),
+	}
+}
+
+// flushDueChanges hands every pendingChange whose debounce window has
+// elapsed to handleChange, as the single coalesced event it collapsed down
+// to.
+func flushDueChanges() {
+	now := time.Now()
+	for path, pending := range pendingChanges {
+		if now.Before(pending.deadline) {
+			continue
+		}
+		delete(pendingChanges, path)
+		handleChange(fsnotify.Event{Name: path, Op: pending.op})
+	}
+}
+
+// runPeriodicRescan re-explores indexDir and reports back on rescanDone so
+// handleFiles can count the completed rescan without touching stats from
+// another goroutine. exploreIndexDir itself queues any out-of-date or newly
+// discovered file through the normal foundFile/needsReparse path.
+func runPeriodicRescan(indexDir []string) {
+	exploreIndexDir(indexDir)
+	rescanDone <- true
+}
+
 func handleDirChange(event fsnotify.Event) {
 	switch {
 	case event.Op&(fsnotify.Create) != 0:
@@ -294,17 +757,20 @@ func handleFiles(indexDir []string) {
 				return
 			}
 			doneFileToParse(tudb)
-			// process changes in files
+			// process changes in files: coalesce raw fsnotify events instead
+			// of handling them straight away, so a git checkout or
+			// make clean && make doesn't enqueue a reparse per raw event
 		case event := <-watcher.Events:
-			handleChange(event)
+			coalesceEvent(event)
+		case <-debounceTick:
+			flushDueChanges()
 		case err := <-watcher.Errors:
 			log.Println("watcher error: ", err)
 		// process explored files
 		case header := <-foundHeader:
 			parseIncluders(header)
 		case file := <-foundFile:
-			exist, uptodate, err := db.UptodateFile(file)
-			if err == nil && (!exist || !uptodate) {
+			if needsReparse(file) {
 				queueFilesToParse(file)
 			}
 		case file := <-removeFile:
@@ -317,6 +783,13 @@ func handleFiles(indexDir []string) {
 		// flush frequently to disk
 		case <-flush:
 			db.FlushDB(time.Now().Add(-time.Duration(flushTime) * time.Second))
+		// catch anything fsnotify missed (unreliable on NFS, overlayfs, ...)
+		case <-rescanTick:
+			go runPeriodicRescan(indexDir)
+		case <-rescanDone:
+			statsMu.Lock()
+			stats.rescansCompleted++
+			statsMu.Unlock()
 		// handle requests
 		case conn := <-newConn:
 			rh.handleRequest(conn)
@@ -363,13 +836,22 @@ func exploreIndexDir(indexDir []string) {
 	}
 }
 
-func startFilesHandler(indexDir []string, inputIndexThreads int, dbDir string) error {
+func startFilesHandler(indexDir []string, inputIndexThreads int, dbDir string, inputHashCheck bool,
+	inputDebounceWindow, inputRescanInterval time.Duration) error {
 	var err error
 
 	toParseMap = make(map[string]bool)
 	toParseQueue = list.New()
 	inFlight = make(map[string]bool)
 	nIndexingThreads = inputIndexThreads
+	hashCheck = inputHashCheck
+	contentCache = make(map[string]contentCacheEntry)
+	lastParsedDigest = make(map[string][sha256.Size]byte)
+	lastParsedHeaders = make(map[string][]string)
+	lastHeaderDigest = make(map[string][sha256.Size]byte)
+	fileDiagnostics = make(map[string][]DiagInfo)
+	lastNotifiedErrorCount = make(map[string]int)
+	errSubs = make(map[chan FileErrorEvent]bool)
 	parseFile = make(chan string)
 	doneFile = make(chan *symbolsTUDB)
 	foundFile = make(chan string)
@@ -381,6 +863,31 @@ func startFilesHandler(indexDir []string, inputIndexThreads int, dbDir string) e
 		return err
 	}
 	flush = time.Tick(time.Duration(flushTime) * time.Second)
+
+	pendingChanges = make(map[string]pendingChange)
+	// a non-positive window means "don't debounce": clamp rather than let a
+	// negative deadline do something surprising. debounceTick itself still
+	// ticks on the fixed debounceCheckInterval, which is always positive.
+	debounceWindow = inputDebounceWindow
+	if debounceWindow < 0 {
+		debounceWindow = 0
+	}
+	debounceTick = time.Tick(debounceCheckInterval)
+
+	// time.Tick panics for a non-positive duration; a user passing
+	// -rescan-interval=0 clearly means "disable the periodic rescan", so
+	// leave rescanTick nil rather than crash. A nil channel is never
+	// selected, which is exactly "disabled".
+	if inputRescanInterval > 0 {
+		rescanTick = time.Tick(inputRescanInterval)
+	} else {
+		rescanTick = nil
+	}
+	rescanDone = make(chan bool)
+
+	if err := UpdateSchema(dbDir); err != nil {
+		return err
+	}
 	db = newSymbolsDB(dbDir)
 	rh = newRequestHandler(db)
 
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+func resetHeaderDigestState(enableHashCheck bool) func() {
+	origHashCheck := hashCheck
+	origDigests := lastHeaderDigest
+	hashCheck = enableHashCheck
+	lastHeaderDigest = make(map[string][sha256.Size]byte)
+	return func() {
+		hashCheck = origHashCheck
+		lastHeaderDigest = origDigests
+	}
+}
+
+func TestHeaderChangedDetectsRealContentChange(t *testing.T) {
+	defer resetHeaderDigestState(true)()
+
+	dir, err := ioutil.TempDir("", "navc-header-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := filepath.Join(dir, "a.h")
+	if err := ioutil.WriteFile(h, []byte("int x;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !headerChanged(h) {
+		t.Error("first sight of a header should report changed")
+	}
+	if headerChanged(h) {
+		t.Error("unchanged content should not report changed")
+	}
+
+	if err := ioutil.WriteFile(h, []byte("int y;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !headerChanged(h) {
+		t.Error("a real content change should report changed")
+	}
+}
+
+func TestHeaderChangedAlwaysTrueWithoutHashCheck(t *testing.T) {
+	defer resetHeaderDigestState(false)()
+
+	if !headerChanged("/does/not/matter") {
+		t.Error("headerChanged should always report changed when -hash-check is disabled")
+	}
+}
+
+func TestHeaderChangedMissingFileReportsChanged(t *testing.T) {
+	defer resetHeaderDigestState(true)()
+
+	if !headerChanged("/does/not/exist/a.h") {
+		t.Error("an unreadable header should report changed so its includers still react")
+	}
+}
+
+func resetErrorNotificationState() func() {
+	origDiags := fileDiagnostics
+	origLastCount := lastNotifiedErrorCount
+	origSubs := errSubs
+	fileDiagnostics = map[string][]DiagInfo{}
+	lastNotifiedErrorCount = map[string]int{}
+	errSubs = map[chan FileErrorEvent]bool{}
+	return func() {
+		fileDiagnostics = origDiags
+		lastNotifiedErrorCount = origLastCount
+		errSubs = origSubs
+	}
+}
+
+func TestNotifyIfErrorsChangedFiresOnFirstResultAndOnChangeOnly(t *testing.T) {
+	defer resetErrorNotificationState()()
+
+	rh := &RequestHandler{}
+	ch := make(chan FileErrorEvent, 1)
+	rh.SubscribeErrors(ch)
+	defer rh.UnsubscribeErrors(ch)
+
+	fileDiagnostics["a.c"] = []DiagInfo{{Severity: "error"}}
+	notifyIfErrorsChanged("a.c")
+	select {
+	case ev := <-ch:
+		if ev.File != "a.c" || len(ev.Errors) != 1 {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	default:
+		t.Error("expected a FileErrorEvent for the first recorded result")
+	}
+
+	// same count again: doneFileToParse re-running (e.g. a no-op rescan)
+	// should not produce a second event
+	notifyIfErrorsChanged("a.c")
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event for an unchanged error count: %+v", ev)
+	default:
+	}
+
+	// error count actually changes: should fire again
+	fileDiagnostics["a.c"] = nil
+	notifyIfErrorsChanged("a.c")
+	select {
+	case ev := <-ch:
+		if len(ev.Errors) != 0 {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	default:
+		t.Error("expected a FileErrorEvent once the error count dropped to 0")
+	}
+}
+
+func TestUnsubscribeErrorsStopsDelivery(t *testing.T) {
+	defer resetErrorNotificationState()()
+
+	rh := &RequestHandler{}
+	ch := make(chan FileErrorEvent, 1)
+	rh.SubscribeErrors(ch)
+	rh.UnsubscribeErrors(ch)
+
+	fileDiagnostics["a.c"] = []DiagInfo{{Severity: "error"}}
+	notifyIfErrorsChanged("a.c")
+
+	select {
+	case ev := <-ch:
+		t.Errorf("unsubscribed channel should not receive events, got %+v", ev)
+	default:
+	}
+}
+
+func resetPendingChanges() {
+	pendingChanges = make(map[string]pendingChange)
+	debounceWindow = time.Minute // long enough that a test never crosses it
+}
+
+func TestCoalesceEventCreateThenWriteCollapsesToWrite(t *testing.T) {
+	resetPendingChanges()
+
+	coalesceEvent(fsnotify.Event{Name: "a.c", Op: fsnotify.Create})
+	coalesceEvent(fsnotify.Event{Name: "a.c", Op: fsnotify.Write})
+
+	got := pendingChanges["a.c"].op
+	if got != fsnotify.Write {
+		t.Errorf("Create+Write = %v, want %v", got, fsnotify.Write)
+	}
+}
+
+func TestCoalesceEventRemoveDropsPendingWrite(t *testing.T) {
+	resetPendingChanges()
+
+	coalesceEvent(fsnotify.Event{Name: "a.c", Op: fsnotify.Write})
+	coalesceEvent(fsnotify.Event{Name: "a.c", Op: fsnotify.Remove})
+
+	got := pendingChanges["a.c"].op
+	if got != fsnotify.Remove {
+		t.Errorf("Write+Remove = %v, want %v", got, fsnotify.Remove)
+	}
+}
+
+func TestCoalesceEventDistinctPathsDoNotMerge(t *testing.T) {
+	resetPendingChanges()
+
+	coalesceEvent(fsnotify.Event{Name: "a.c", Op: fsnotify.Write})
+	coalesceEvent(fsnotify.Event{Name: "b.c", Op: fsnotify.Create})
+
+	if len(pendingChanges) != 2 {
+		t.Fatalf("expected 2 independent pending changes, got %d", len(pendingChanges))
+	}
+	if pendingChanges["a.c"].op != fsnotify.Write {
+		t.Errorf("a.c op = %v, want %v", pendingChanges["a.c"].op, fsnotify.Write)
+	}
+	if pendingChanges["b.c"].op != fsnotify.Create {
+		t.Errorf("b.c op = %v, want %v", pendingChanges["b.c"].op, fsnotify.Create)
+	}
+}
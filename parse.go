@@ -18,16 +18,24 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 
 	"github.com/go-clang/v3.6/clang"
 )
 
 type parse struct {
 	cas map[string][]string
+	// defaultArgs is used for any file with no entry in cas, populated from
+	// compile_flags.txt when there is no compile_commands.json to index by
+	// file. Only one set is kept: with several input directories, the last
+	// compile_flags.txt read is used for every file without a cas entry,
+	// whichever input directory the file is under.
+	defaultArgs []string
 }
 
 /*
@@ -47,11 +55,25 @@ type parse struct {
  * Then, we need to make sure that the directories in the -I options also match
  * the relative or absolute path from the input. This is fixed in fixCompDirArg
  * right before populating the arguments for some specific file.
+ *
+ * The JSON Compilation Database spec allows the per-file arguments to be
+ * given either as a single shell-escaped Command string or as an already
+ * tokenized Arguments array (the form CMake and Bear produce); we prefer
+ * Arguments when present and otherwise tokenize Command ourselves with
+ * tokenizeCommand, which understands quoting well enough for paths
+ * containing spaces. Either form can reference a response file (@file),
+ * which expandResponseFiles inlines before we look at individual flags.
+ *
+ * When a directory has no compile_commands.json at all, we fall back to
+ * the simpler compile_flags.txt format (one flag per line, applying to
+ * every file under that directory), the second format clang's tooling
+ * standardizes on.
  */
 
 type compArgs struct {
 	Directory string
 	Command   string
+	Arguments []string
 	File      string
 }
 
@@ -106,62 +128,246 @@ func fixCompDirArg(argDir, path string) string {
 	return filepath.Clean(path + "/" + argDir)
 }
 
-func getCompArgs(command, path string) []string {
-	args := []string{}
+// compDirArgFlags are the flags whose following argument is a path, so it
+// needs fixCompDirArg applied the same way -I already did, or relative
+// includes stop resolving once the path has been rewritten to match navc's
+// input.
+var compDirArgFlags = map[string]bool{
+	"-isystem": true,
+	"-iquote":  true,
+	"-include": true,
+	"-F":       true,
+}
 
-	argsList := strings.Fields(command)
+// passthroughArgFlags affect clang's preprocessing/parsing but carry no
+// navc-relative path, so they're forwarded to ParseTranslationUnit as-is.
+var passthroughArgFlags = map[string]bool{
+	"-target":   true,
+	"-x":        true,
+	"-nostdinc": true,
+}
+
+func getCompArgs(argsList []string, path string) []string {
+	args := []string{}
 
-	for i, arg := range argsList {
+	for i := 0; i < len(argsList); i++ {
+		arg := argsList[i]
 		switch {
 		case arg == "-D":
 			args = append(args, arg, argsList[i+1])
+			i++
 		case strings.HasPrefix(arg, "-D"):
 			args = append(args, arg)
+		case strings.HasPrefix(arg, "-std="):
+			args = append(args, arg)
 		case arg == "-I":
 			argDir := fixCompDirArg(argsList[i+1], path)
 			args = append(args, "-I", argDir)
+			i++
 		case strings.HasPrefix(arg, "-I"):
 			argDir := fixCompDirArg(
 				strings.Replace(arg, "-I", "", 1),
 				path)
 			args = append(args, "-I", argDir)
+		case compDirArgFlags[arg]:
+			argDir := fixCompDirArg(argsList[i+1], path)
+			args = append(args, arg, argDir)
+			i++
+		case passthroughArgFlags[arg]:
+			args = append(args, arg)
+			if arg == "-target" || arg == "-x" {
+				args = append(args, argsList[i+1])
+				i++
+			}
 		}
 	}
 
 	return args
 }
 
-func newParser(inputDirs []string) *parse {
-	ret := &parse{make(map[string][]string)}
+// tokenizeCommand splits a shell-escaped Command string into argv the way a
+// shell would, honoring single/double quoting and backslash escapes, so
+// flags like -DFOO="a b" survive as one argument instead of being split on
+// the space inside the quotes.
+func tokenizeCommand(command string) []string {
+	args := []string{}
+	var cur []rune
+	inSingle, inDouble := false, false
+	flush := func() {
+		if len(cur) > 0 {
+			args = append(args, string(cur))
+			cur = nil
+		}
+	}
 
-	// read compilation args db and fix files paths
-	for _, path := range inputDirs {
-		f, err := os.Open(path + "/compile_commands.json")
-		if os.IsPermission(err) {
-			log.Panic("error opening compile db: ", err)
-		} else if err != nil {
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\' && !inSingle && i+1 < len(runes):
+			i++
+			cur = append(cur, runes[i])
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case unicode.IsSpace(c) && !inSingle && !inDouble:
+			flush()
+		default:
+			cur = append(cur, c)
+		}
+	}
+	flush()
+
+	return args
+}
+
+// expandResponseFiles inlines any @file argument with the tokenized
+// contents of that file, recursively, so a command using a response file
+// (common with long include/define lists) sees the same flags a real
+// invocation of clang would.
+func expandResponseFiles(args []string) []string {
+	expanded := []string{}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
 			continue
 		}
-		defer f.Close()
 
-		dec := json.NewDecoder(f)
-		var cas []compArgs
-		err = dec.Decode(&cas)
+		data, err := ioutil.ReadFile(arg[1:])
 		if err != nil {
-			log.Panic(err)
+			log.Println("unable to read response file", arg[1:], ":", err)
+			continue
+		}
+		expanded = append(expanded, expandResponseFiles(tokenizeCommand(string(data)))...)
+	}
+
+	return expanded
+}
+
+// commandArgs returns ca's compiler arguments as argv, preferring the
+// Arguments array (already tokenized) over Command (which we tokenize
+// ourselves), and expanding any response file either may reference.
+func commandArgs(ca compArgs) []string {
+	if len(ca.Arguments) > 0 {
+		return expandResponseFiles(ca.Arguments)
+	}
+	return expandResponseFiles(tokenizeCommand(ca.Command))
+}
+
+// readCompileCommands reads path/compile_commands.json, returning false if
+// it doesn't exist so the caller can fall back to compile_flags.txt.
+func readCompileCommands(path string) ([]compArgs, bool) {
+	f, err := os.Open(path + "/compile_commands.json")
+	if os.IsPermission(err) {
+		log.Panic("error opening compile db: ", err)
+	} else if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	var cas []compArgs
+	if err := dec.Decode(&cas); err != nil {
+		log.Panic(err)
+	}
+
+	return cas, true
+}
+
+// readCompileFlags reads the simpler path/compile_flags.txt format (one
+// flag per line, applying to every file under path) used when there is no
+// per-file compile_commands.json.
+func readCompileFlags(path string) ([]string, bool) {
+	data, err := ioutil.ReadFile(path + "/compile_flags.txt")
+	if os.IsPermission(err) {
+		log.Panic("error opening compile_flags.txt: ", err)
+	} else if err != nil {
+		return nil, false
+	}
+
+	flags := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			flags = append(flags, line)
 		}
+	}
+
+	return flags, true
+}
 
-		fixPaths(cas, path)
+func newParser(inputDirs []string) *parse {
+	ret := &parse{cas: make(map[string][]string)}
+
+	for _, path := range inputDirs {
+		if cas, ok := readCompileCommands(path); ok {
+			fixPaths(cas, path)
 
-		// index compArgs by file names
-		for _, ca := range cas {
-			ret.cas[ca.File] = getCompArgs(ca.Command, path)
+			// index compArgs by file names
+			for _, ca := range cas {
+				ret.cas[ca.File] = getCompArgs(commandArgs(ca), path)
+			}
+			continue
+		}
+
+		if flags, ok := readCompileFlags(path); ok {
+			ret.defaultArgs = getCompArgs(flags, path)
 		}
 	}
 
 	return ret
 }
 
+// DiagInfo is a single libclang diagnostic attached to a TU, kept around so
+// a client can later ask "why didn't this symbol resolve" without having to
+// reparse the file itself.
+type DiagInfo struct {
+	Severity string
+	Spelling string
+	Loc      SymbolLocReq
+}
+
+func diagSeverityString(severity clang.DiagnosticSeverity) string {
+	switch severity {
+	case clang.Diagnostic_Note:
+		return "note"
+	case clang.Diagnostic_Warning:
+		return "warning"
+	case clang.Diagnostic_Error:
+		return "error"
+	case clang.Diagnostic_Fatal:
+		return "fatal"
+	default:
+		return "ignored"
+	}
+}
+
+// collectDiagnostics walks tu's diagnostics so callers can see why a TU
+// only partially parsed (missing -I, wrong -D, syntax errors, ...) instead
+// of silently failing symbol lookups.
+func collectDiagnostics(tu *clang.TranslationUnit) []DiagInfo {
+	diags := []DiagInfo{}
+
+	for i := uint32(0); i < tu.NumDiagnostics(); i++ {
+		diag := tu.Diagnostic(i)
+		defer diag.Dispose()
+
+		file, line, col, _ := diag.Location().FileLocation()
+		diags = append(diags, DiagInfo{
+			Severity: diagSeverityString(diag.Severity()),
+			Spelling: diag.Spelling(),
+			Loc: SymbolLocReq{
+				filepath.Clean(file.Name()),
+				int(line),
+				int(col),
+			},
+		})
+	}
+
+	return diags
+}
+
 func getSymbolFromCursor(cursor *clang.Cursor) *symbolInfo {
 	if cursor.IsNull() {
 		return nil
@@ -186,13 +392,18 @@ func (pa *parse) Parse(file string) *symbolsTUDB {
 
 	args, ok := pa.cas[file]
 	if !ok {
-		args = []string{}
+		args = pa.defaultArgs
 	}
 	tu := idx.ParseTranslationUnit(file, args, nil, clang.TranslationUnit_DetailedPreprocessingRecord)
 	defer tu.Dispose()
 
 	db := newSymbolsTUDB(file, tu.File(file).Time())
 	defer db.TempSaveDB()
+	// queryable via (*RequestHandler).GetFileErrors/GetAllErrors in files.go;
+	// doneFileToParse notifies SubscribeErrors subscribers once this lands
+	recordDiagnostics(file, collectDiagnostics(tu))
+
+	var headers []string
 
 	visitNode := func(cursor, parent clang.Cursor) clang.ChildVisitResult {
 		if cursor.IsNull() {
@@ -246,6 +457,7 @@ func (pa *parse) Parse(file string) *symbolsTUDB {
 		case clang.Cursor_InclusionDirective:
 			incFile := cursor.IncludedFile()
 			db.InsertHeader(cursor.Spelling(), incFile)
+			headers = append(headers, incFile)
 		}
 
 		return clang.ChildVisit_Recurse
@@ -253,5 +465,15 @@ func (pa *parse) Parse(file string) *symbolsTUDB {
 
 	tu.TranslationUnitCursor().Visit(visitNode)
 
+	// record the content digest this parse was run against, so a later
+	// mtime-only change can be recognized as a no-op reparse (see
+	// needsReparse in files.go). This is kept in memory for the daemon's
+	// current run only: persisting it across restarts would mean adding a
+	// field to symbolsTUDB and its gob encoding in symbols-db.go, which
+	// isn't part of this chunk.
+	if digest, ok := contentDigest(file, headers); ok {
+		recordParsedDigest(file, headers, digest)
+	}
+
 	return db
 }
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeCommand(t *testing.T) {
+	cases := []struct {
+		command string
+		want    []string
+	}{
+		{`gcc -c foo.c`, []string{"gcc", "-c", "foo.c"}},
+		{`gcc -DFOO="a b" foo.c`, []string{"gcc", "-DFOO=a b", "foo.c"}},
+		{`gcc -DFOO='a b' foo.c`, []string{"gcc", "-DFOO=a b", "foo.c"}},
+		{`gcc -I/path/with\ space foo.c`, []string{"gcc", "-I/path/with space", "foo.c"}},
+		{`  gcc   -c   foo.c  `, []string{"gcc", "-c", "foo.c"}},
+		{``, []string{}},
+	}
+
+	for _, c := range cases {
+		got := tokenizeCommand(c.command)
+		if len(got) == 0 {
+			got = []string{}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("tokenizeCommand(%q) = %#v, want %#v", c.command, got, c.want)
+		}
+	}
+}
+
+func TestExpandResponseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "navc-parse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsp := filepath.Join(dir, "flags.rsp")
+	if err := ioutil.WriteFile(rsp, []byte("-DFOO -DBAR=1\n-Iinclude"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := expandResponseFiles([]string{"-c", "@" + rsp, "foo.c"})
+	want := []string{"-c", "-DFOO", "-DBAR=1", "-Iinclude", "foo.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandResponseFiles = %#v, want %#v", got, want)
+	}
+}
+
+func TestExpandResponseFilesMissingFileIsDropped(t *testing.T) {
+	got := expandResponseFiles([]string{"-c", "@/does/not/exist", "foo.c"})
+	want := []string{"-c", "foo.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandResponseFiles = %#v, want %#v", got, want)
+	}
+}
+
+func TestGetCompArgs(t *testing.T) {
+	argsList := []string{
+		"gcc",
+		"-DFOO",
+		"-DBAR=1",
+		"-Iinclude",
+		"-I", "other",
+		"-isystem", "sys",
+		"-include", "prefix.h",
+		"-std=c99",
+		"-target", "x86_64-linux-gnu",
+		"-x", "c",
+		"-nostdinc",
+		"-Wall", // not a flag we forward
+		"foo.c",
+	}
+
+	got := getCompArgs(argsList, "/proj")
+	want := []string{
+		"-DFOO",
+		"-DBAR=1",
+		"-I", "/proj/include",
+		"-I", "/proj/other",
+		"-isystem", "/proj/sys",
+		"-include", "/proj/prefix.h",
+		"-std=c99",
+		"-target", "x86_64-linux-gnu",
+		"-x", "c",
+		"-nostdinc",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getCompArgs = %#v, want %#v", got, want)
+	}
+}
+
+func TestCommandArgsPrefersArguments(t *testing.T) {
+	ca := compArgs{
+		Command:   "gcc -DFROM_COMMAND foo.c",
+		Arguments: []string{"gcc", "-DFROM_ARGUMENTS", "foo.c"},
+	}
+
+	got := commandArgs(ca)
+	want := []string{"gcc", "-DFROM_ARGUMENTS", "foo.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commandArgs = %#v, want %#v", got, want)
+	}
+}
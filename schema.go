@@ -0,0 +1,124 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * This module keeps the on-disk DB (dbDir, see symbols-db.go) forward
+ * compatible across navc versions. symbolsTUDB is gob-encoded directly to
+ * disk with no version tag, so any change to its layout used to silently
+ * corrupt existing indexes and forced users to rm -rf their DB.
+ *
+ * dbDir/VERSION now holds a single integer: the schemaVersion the DB was
+ * last written with. startFilesHandler calls UpdateSchema before it opens
+ * dbDir via newSymbolsDB; UpdateSchema runs every registered migration
+ * between the persisted version and schemaVersion, in order, then rewrites
+ * VERSION. A fresh dbDir (no VERSION file) is treated as version 0. A dbDir
+ * whose VERSION is newer than this binary's schemaVersion means an older
+ * navc opened a DB written by a newer one; we refuse to touch it rather
+ * than risk corrupting data the newer binary understands but we don't.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// schemaVersion is the layout version symbolsTUDB (and any other struct
+// persisted under dbDir) is currently written with. Bump it and add a
+// migration whenever that layout changes.
+const schemaVersion int = 1
+
+const schemaVersionFile string = "VERSION"
+
+// migration brings every file under dbDir from the version it was
+// registered for up to the next one. Migrations are applied in order, so a
+// DB several versions behind runs all of them in sequence.
+type migration func(dbDir string) error
+
+// migrations[i] moves a dbDir from version i to version i+1.
+var migrations = []migration{
+	migrateV0ToV1,
+}
+
+// readSchemaVersion returns the schema version dbDir was last written with,
+// or 0 if dbDir has no VERSION file yet (i.e. it predates schema
+// versioning, or was just created).
+func readSchemaVersion(dbDir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dbDir, schemaVersionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("corrupt %s in %s: %v", schemaVersionFile, dbDir, err)
+	}
+	return version, nil
+}
+
+func writeSchemaVersion(dbDir string, version int) error {
+	data := []byte(strconv.Itoa(version))
+	return ioutil.WriteFile(filepath.Join(dbDir, schemaVersionFile), data, 0644)
+}
+
+// UpdateSchema brings dbDir up to schemaVersion, running any migration that
+// hasn't been applied yet. It is called once from startFilesHandler before
+// dbDir is handed to newSymbolsDB.
+func UpdateSchema(dbDir string) error {
+	version, err := readSchemaVersion(dbDir)
+	if err != nil {
+		return err
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf(
+			"%s was written by a newer navc (schema %d, this binary understands up to %d); refusing to start",
+			dbDir, version, schemaVersion)
+	}
+
+	for ; version < schemaVersion; version++ {
+		log.Println("migrating", dbDir, "from schema", version, "to", version+1)
+		if err := migrations[version](dbDir); err != nil {
+			return fmt.Errorf("migrating %s to schema %d: %v", dbDir, version+1, err)
+		}
+		if err := writeSchemaVersion(dbDir, version+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateV0ToV1 covers DBs written before schema versioning existed. The
+// diagnostics and content-hash work this chunk added (see files.go) keeps
+// its state in memory rather than as new symbolsTUDB fields, since
+// symbolsTUDB's gob encoding lives in symbols-db.go outside this chunk and
+// can't be safely rewritten here. So v0 and v1 share the same on-disk TUDB
+// layout, and this migration is a deliberate no-op: it exists so dbDir
+// always carries an explicit VERSION once opened, and so a future migration
+// that does need to rewrite TUDB files (once it can decode/encode the real
+// symbolsTUDB type) has a registered slot to run in.
+func migrateV0ToV1(dbDir string) error {
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSchemaVersionMissingFileIsZero(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "navc-schema-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	version, err := readSchemaVersion(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("expected version 0 for a fresh dbDir, got %d", version)
+	}
+}
+
+func TestWriteReadSchemaVersionRoundTrip(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "navc-schema-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	if err := writeSchemaVersion(dbDir, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := readSchemaVersion(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Errorf("expected version 3, got %d", version)
+	}
+}
+
+func TestReadSchemaVersionCorrupt(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "navc-schema-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	path := filepath.Join(dbDir, schemaVersionFile)
+	if err := ioutil.WriteFile(path, []byte("not-a-number"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readSchemaVersion(dbDir); err == nil {
+		t.Error("expected an error for a corrupt VERSION file, got nil")
+	}
+}
+
+func TestUpdateSchemaRunsMigrationsInOrderAndStopsAtCurrent(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "navc-schema-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	if err := writeSchemaVersion(dbDir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []int
+	restore := migrations
+	migrations = []migration{
+		func(dbDir string) error { ran = append(ran, 0); return nil },
+	}
+	defer func() { migrations = restore }()
+
+	if err := UpdateSchema(dbDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ran) != 1 || ran[0] != 0 {
+		t.Errorf("expected exactly the version-0 migration to run once, got %v", ran)
+	}
+
+	version, err := readSchemaVersion(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Errorf("expected dbDir to be left at schemaVersion %d, got %d", schemaVersion, version)
+	}
+
+	// running again with the DB already at schemaVersion should not rerun
+	// any migration
+	ran = nil
+	if err := UpdateSchema(dbDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("expected no migrations to rerun once up to date, got %v", ran)
+	}
+}
+
+func TestUpdateSchemaRefusesNewerVersion(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "navc-schema-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	if err := writeSchemaVersion(dbDir, schemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateSchema(dbDir); err == nil {
+		t.Error("expected UpdateSchema to refuse a dbDir newer than schemaVersion, got nil")
+	}
+}